@@ -5,23 +5,47 @@
 // Author: Chris Mayenschein
 // GitHub: https://github.com/cmayen/paila
 // Date: 2025-07-20
-// Last Modified: 2025-07-21
+// Last Modified: 2026-10-18
 //
 // Usage: ./paila-ingest-go
+// Usage: ./paila-ingest-go token issue|rotate|revoke <host>
+// Usage: ./paila-ingest-go token list
+// Usage: ./paila-ingest-go secret issue|rotate|revoke <host>
+// Usage: ./paila-ingest-go secret list
+// Usage: ./paila-ingest-go ca init|server <name>...|issue <host>
 //
 // #############################################################################
 
 package main
 
 import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"io"
+	"math/big"
 	"net"
 	"net/http"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 // sudo docker exec -it new-image-name-localtest bash
@@ -29,10 +53,752 @@ import (
 // override listenPort with PAILA_INGEST_PORT env var in main func
 var listenPort string = "8181"
 
-const uploadsDir string = "/.paila-ingest/uploads"
+// override maxUploadSize with PAILA_INGEST_MAX_UPLOAD_MB env var in main func,
+// larger uploads are refused with 413
+var maxUploadSize int64 = 32 << 20
+
 const reportsDir string = "/.paila-ingest/reports"
 const archiveDir string = "/.paila-ingest/archive"
 
+// where uploads are stored and their report jobs queued, vars so the tests
+// can use temporary folders
+var uploadsDir string = "/.paila-ingest/uploads"
+var queueDir string = "/.paila-ingest/queue"
+
+// the enrolled hosts and the hashes of their upload tokens
+const tokensFile string = "/.paila-ingest/tokens.json"
+
+// the enrolled hosts and the secrets they sign their uploads with
+const secretsFile string = "/.paila-ingest/secrets.json"
+
+// the local certificate authority of the ca subcommand, its server
+// certificate and the client certificates issued to the hosts
+var caDir string = "/.paila-ingest/ca"
+
+// override authModes with PAILA_INGEST_AUTH env var in main func, a comma
+// separated list of the accepted ways to authenticate an upload. "token"
+// requires the bearer token issued to the uploading host, "cert" a client
+// certificate issued to the uploading host, "hmac" a signature with the
+// secret of the uploading host, "none" accepts anonymous uploads like before
+// the hosts were enrolled.
+var authModes = []string{"token"}
+
+// remove all non-alphanumeric characters except hyphens and periods
+var sanitizeReg = regexp.MustCompile(`[^a-zA-Z0-9.-]`)
+
+// a host name as used in the stored <host>--<date>.logs.txt names, the "--"
+// separator can't be part of it
+var hostReg = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9.-]*[a-zA-Z0-9])?$`)
+
+// the header lines paila-logpush.sh writes at the top of the logs file
+var logHostReg = regexp.MustCompile(`^= Host: (.*)$`)
+var logDateReg = regexp.MustCompile(`^= Date: (.*)$`)
+
+// job record picked up by the paila-reporter queue worker, the fields and
+// states must match the Job struct in paila-reporter-go.go
+type Job struct {
+	ID        string    `json:"id"`
+	Host      string    `json:"host"`
+	Date      string    `json:"date"`
+	Filename  string    `json:"filename,omitempty"`
+	Source    string    `json:"source"`
+	State     string    `json:"state"`
+	Attempts  int       `json:"attempts"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// newJobID returns a sortable, unique job id.
+func newJobID() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return time.Now().UTC().Format("20060102T150405") + "-" + hex.EncodeToString(b)
+}
+
+// enqueueReport writes a queued job record into the queue folder so
+// paila-reporter generates the report for the upload and moves it into the
+// archive.
+func enqueueReport(host string, date string, filename string) error {
+	if err := os.MkdirAll(queueDir, 0755); err != nil {
+		return fmt.Errorf("failed to create queue directory: %w", err)
+	}
+	now := time.Now().UTC()
+	job := Job{
+		ID:        newJobID(),
+		Host:      host,
+		Date:      date,
+		Filename:  filename,
+		Source:    "upload",
+		State:     "queued",
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	jobBytes, err := json.MarshalIndent(job, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal job: %w", err)
+	}
+	// write to a temp name first so the worker never reads a partial file
+	jobPath := filepath.Join(queueDir, job.ID+".job.json")
+	if err := os.WriteFile(jobPath+".tmp", jobBytes, 0644); err != nil {
+		return fmt.Errorf("failed to write job: %w", err)
+	}
+	return os.Rename(jobPath+".tmp", jobPath)
+}
+
+// =============================================================================
+// host credentials
+// every host is enrolled with its own upload token and/or signing secret.
+// only the sha256 of a token is stored, a secret has to be kept as is to
+// verify the signatures. either is printed once when it is issued or rotated
+// and has to be put into the paila-logpush.sh config of the host.
+
+// Credential is the stored token or secret of one host.
+type Credential struct {
+	Hash      string    `json:"hash,omitempty"`
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	RotatedAt time.Time `json:"rotated_at,omitempty"`
+}
+
+// credentialStore is a file of credentials keyed by host, e.g. the tokens.
+type credentialStore struct {
+	kind   string // "token" or "secret", also the name of the subcommand
+	file   string
+	hashed bool   // store the sha256 of the credential instead of itself
+	option string // the paila-logpush.sh option and env var of it
+	env    string
+	mu     sync.Mutex // serializes the read-modify-write of the file
+}
+
+var tokenStore = &credentialStore{kind: "token", file: tokensFile, hashed: true, option: "-t", env: "PAILA_TOKEN"}
+var secretStore = &credentialStore{kind: "secret", file: secretsFile, option: "-s", env: "PAILA_SECRET"}
+
+// hashToken returns the hex sha256 of a token as kept in the token file.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// newCredential returns a random 256 bit credential. secrets are plain hex
+// so paila-logpush.sh can pass them to openssl as the hmac key.
+func (s *credentialStore) newCredential() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	if s.hashed {
+		return "paila_" + hex.EncodeToString(b)
+	}
+	return hex.EncodeToString(b)
+}
+
+// load reads the file, a missing file means no enrolled hosts.
+func (s *credentialStore) load() (map[string]Credential, error) {
+	creds := map[string]Credential{}
+	data, err := os.ReadFile(s.file)
+	if os.IsNotExist(err) {
+		return creds, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s file: %w", s.kind, err)
+	}
+	if err := json.Unmarshal(data, &creds); err != nil {
+		return nil, fmt.Errorf("failed to parse %s file: %w", s.kind, err)
+	}
+	return creds, nil
+}
+
+// save writes the file readable by the owner only.
+func (s *credentialStore) save(creds map[string]Credential) error {
+	data, err := json.MarshalIndent(creds, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal %ss: %w", s.kind, err)
+	}
+	if err := os.MkdirAll(filepath.Dir(s.file), 0755); err != nil {
+		return fmt.Errorf("failed to create %s directory: %w", s.kind, err)
+	}
+	if err := os.WriteFile(s.file+".tmp", data, 0600); err != nil {
+		return fmt.Errorf("failed to write %s file: %w", s.kind, err)
+	}
+	return os.Rename(s.file+".tmp", s.file)
+}
+
+// issue creates the credential of a host. issuing for an enrolled host fails
+// unless rotate is set, rotating replaces the old credential right away.
+func (s *credentialStore) issue(host string, rotate bool) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	creds, err := s.load()
+	if err != nil {
+		return "", err
+	}
+	entry, exists := creds[host]
+	if exists && !rotate {
+		return "", fmt.Errorf("host %s already has a %s, use rotate to replace it", host, s.kind)
+	}
+	if !exists && rotate {
+		return "", fmt.Errorf("host %s has no %s to rotate", host, s.kind)
+	}
+
+	value := s.newCredential()
+	now := time.Now().UTC()
+	if exists {
+		entry.RotatedAt = now
+	} else {
+		entry = Credential{CreatedAt: now}
+	}
+	if s.hashed {
+		entry.Hash = hashToken(value)
+	} else {
+		entry.Secret = value
+	}
+	creds[host] = entry
+	if err := s.save(creds); err != nil {
+		return "", err
+	}
+	return value, nil
+}
+
+// revoke removes the credential of a host, its uploads are refused from now
+// on.
+func (s *credentialStore) revoke(host string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	creds, err := s.load()
+	if err != nil {
+		return err
+	}
+	if _, exists := creds[host]; !exists {
+		return fmt.Errorf("host %s has no %s", host, s.kind)
+	}
+	delete(creds, host)
+	return s.save(creds)
+}
+
+// checkToken reports whether token is the current token of host. the file is
+// read on every upload so tokens issued or revoked by the token subcommand
+// apply without a restart.
+func checkToken(host string, token string) (bool, error) {
+	tokens, err := tokenStore.load()
+	if err != nil {
+		return false, err
+	}
+	entry, exists := tokens[host]
+	if !exists || token == "" {
+		return false, nil
+	}
+	return subtle.ConstantTimeCompare([]byte(hashToken(token)), []byte(entry.Hash)) == 1, nil
+}
+
+// bearerToken returns the token of the Authorization header, or "".
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
+// credentialCommand runs the token and secret subcommands used to enroll
+// hosts, e.g.
+//
+//	docker exec -it paila-ingest ./paila-ingest-go token issue web01
+func credentialCommand(s *credentialStore, args []string) int {
+	usage := fmt.Sprintf("Usage: paila-ingest-go %s issue|rotate|revoke <host>\n       paila-ingest-go %s list", s.kind, s.kind)
+	if len(args) == 1 && args[0] == "list" {
+		creds, err := s.load()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		hosts := make([]string, 0, len(creds))
+		for host := range creds {
+			hosts = append(hosts, host)
+		}
+		sort.Strings(hosts)
+		for _, host := range hosts {
+			entry := creds[host]
+			line := fmt.Sprintf("%-30s created %s", host, entry.CreatedAt.Format(time.RFC3339))
+			if !entry.RotatedAt.IsZero() {
+				line += ", rotated " + entry.RotatedAt.Format(time.RFC3339)
+			}
+			fmt.Println(line)
+		}
+		return 0
+	}
+	if len(args) != 2 {
+		fmt.Fprintln(os.Stderr, usage)
+		return 1
+	}
+
+	// the host must be one uploadHandler accepts
+	host := args[1]
+	if err := validateHost(host); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	switch args[0] {
+	case "issue", "rotate":
+		value, err := s.issue(host, args[0] == "rotate")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Printf("%s for %s, it is only shown once:\n\n  %s\n\n", strings.ToUpper(s.kind[:1])+s.kind[1:], host, value)
+		fmt.Printf("Set it on the host with %s=%s or ./paila-logpush.sh %s %s\n", s.env, value, s.option, value)
+	case "revoke":
+		if err := s.revoke(host); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Printf("%s for %s revoked\n", strings.ToUpper(s.kind[:1])+s.kind[1:], host)
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		return 1
+	}
+	return 0
+}
+
+// =============================================================================
+// signed uploads
+// for hosts without TLS, paila-logpush.sh signs every upload with the secret
+// of the host using only curl and openssl. the signature is the hex
+// HMAC-SHA256 over
+//
+//	paila-v1\n<host>\n<date>\n<timestamp>\n<nonce>\n<hex sha256 of the log file>
+//
+// sent along with the unix timestamp and a random nonce in the X-Paila-*
+// headers. requests older than signatureMaxAge are refused and the nonces of
+// the accepted ones are remembered for as long, so a captured upload can't be
+// replayed. the nonces are kept in memory only, a restart forgets them, but a
+// request captured before the restart still expires with its timestamp.
+
+const signatureHeader = "X-Paila-Signature"
+const timestampHeader = "X-Paila-Timestamp"
+const nonceHeader = "X-Paila-Nonce"
+const signatureMaxAge = 5 * time.Minute
+
+// the nonces of the accepted signed uploads and when they can be forgotten
+var seenNonces = map[string]time.Time{}
+var seenNoncesMu sync.Mutex
+
+// useNonce records the nonce of host and reports false when it was already
+// used within signatureMaxAge.
+func useNonce(host string, nonce string) bool {
+	seenNoncesMu.Lock()
+	defer seenNoncesMu.Unlock()
+
+	now := time.Now()
+	for key, expires := range seenNonces {
+		if now.After(expires) {
+			delete(seenNonces, key)
+		}
+	}
+	key := host + "\n" + nonce
+	if _, seen := seenNonces[key]; seen {
+		return false
+	}
+	// the timestamp may be up to signatureMaxAge in the future as well
+	seenNonces[key] = now.Add(2 * signatureMaxAge)
+	return true
+}
+
+// signedPayload returns the string the signature is calculated over.
+func signedPayload(host string, date string, timestamp string, nonce string, bodyHash string) string {
+	return strings.Join([]string{"paila-v1", host, date, timestamp, nonce, bodyHash}, "\n")
+}
+
+// checkSignature verifies the signature headers of an upload for host and
+// date, along with the reason when they don't verify. the log file of the
+// parsed form is hashed and rewound for the handler.
+func checkSignature(r *http.Request, host string, date string) (bool, string) {
+	signature := r.Header.Get(signatureHeader)
+	timestamp := r.Header.Get(timestampHeader)
+	nonce := r.Header.Get(nonceHeader)
+	if signature == "" || timestamp == "" || nonce == "" {
+		return false, "Missing signature headers for host " + host
+	}
+	if len(nonce) < 16 || len(nonce) > 64 {
+		return false, "Invalid nonce"
+	}
+
+	// stale or future requests
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false, "Invalid timestamp"
+	}
+	age := time.Since(time.Unix(ts, 0))
+	if age > signatureMaxAge || age < -signatureMaxAge {
+		return false, "Signature timestamp is too old or too far in the future, check the clock of the host"
+	}
+
+	secrets, err := secretStore.load()
+	if err != nil {
+		fmt.Printf("Error checking signature for %s: %v\n", host, err)
+		return false, "Error checking signature"
+	}
+	entry, exists := secrets[host]
+	if !exists {
+		return false, "No secret issued for host " + host
+	}
+	key, err := hex.DecodeString(entry.Secret)
+	if err != nil {
+		fmt.Printf("Error checking signature for %s: invalid secret: %v\n", host, err)
+		return false, "Error checking signature"
+	}
+
+	// hash the log file
+	file, _, err := r.FormFile("log")
+	if err != nil {
+		return false, "Missing file 'log' to verify the signature"
+	}
+	defer file.Close()
+	bodyHash := sha256.New()
+	if _, err := io.Copy(bodyHash, file); err != nil {
+		return false, "Error reading file 'log'"
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return false, "Error reading file 'log'"
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(signedPayload(host, date, timestamp, nonce, hex.EncodeToString(bodyHash.Sum(nil)))))
+	expected := hex.EncodeToString(mac.Sum(nil))
+	if subtle.ConstantTimeCompare([]byte(strings.ToLower(signature)), []byte(expected)) != 1 {
+		return false, "Invalid signature for host " + host
+	}
+
+	// only a valid signature uses up its nonce
+	if !useNonce(host, nonce) {
+		return false, "Replayed request for host " + host
+	}
+	return true, ""
+}
+
+// =============================================================================
+// upload authorization
+
+// authEnabled reports whether mode is one of the accepted auth modes.
+func authEnabled(mode string) bool {
+	for _, m := range authModes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// authorizeUpload reports whether the request may upload logs for host and
+// date, along with the reason when it may not.
+func authorizeUpload(r *http.Request, host string, date string) (bool, string) {
+	// a verified client certificate always names the host it was issued to,
+	// whatever the accepted modes
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		cn := r.TLS.VerifiedChains[0][0].Subject.CommonName
+		if cn != host {
+			return false, "Client certificate of " + cn + " does not match host " + host
+		}
+		if authEnabled("cert") {
+			return true, ""
+		}
+	}
+	if authEnabled("none") {
+		return true, ""
+	}
+
+	// every credential sent for an accepted mode is tried, no mode takes
+	// precedence. a host moving from tokens to signatures may send both.
+	var refused []string
+	if authEnabled("token") && bearerToken(r) != "" {
+		ok, err := checkToken(host, bearerToken(r))
+		switch {
+		case err != nil:
+			fmt.Printf("Error checking token for %s: %v\n", host, err)
+			refused = append(refused, "Error checking token")
+		case ok:
+			return true, ""
+		default:
+			refused = append(refused, "Invalid token for host "+host)
+		}
+	}
+	if authEnabled("hmac") && r.Header.Get(signatureHeader) != "" {
+		ok, reason := checkSignature(r, host, date)
+		if ok {
+			return true, ""
+		}
+		refused = append(refused, reason)
+	}
+	if len(refused) > 0 {
+		return false, strings.Join(refused, ", ")
+	}
+
+	// nothing was sent for the accepted modes
+	var missing []string
+	for _, m := range authModes {
+		switch m {
+		case "token":
+			missing = append(missing, "token")
+		case "cert":
+			missing = append(missing, "client certificate")
+		case "hmac":
+			missing = append(missing, "signature")
+		}
+	}
+	return false, "Missing " + strings.Join(missing, " or ") + " for host " + host
+}
+
+// =============================================================================
+// certificate authority
+// a small local CA so the uploads can run over TLS with a client certificate
+// per host, without an outside PKI. everything lives in caDir: ca.crt and
+// ca.key, the server certificate in server.crt and server.key and the host
+// certificates in hosts/<host>.crt and hosts/<host>.key. keys are ECDSA P-256.
+
+// validity of the certificates issued by the ca subcommand
+const caValidity = 10 * 365 * 24 * time.Hour
+const certValidity = 2 * 365 * 24 * time.Hour
+
+// newSerial returns a random 128 bit certificate serial number.
+func newSerial() *big.Int {
+	serial, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	return serial
+}
+
+// writePEM writes a single pem block to path.
+func writePEM(path string, blockType string, der []byte, perm os.FileMode) error {
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := os.WriteFile(path, data, perm); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return nil
+}
+
+// writeKeyPair writes a certificate and its private key as <base>.crt and
+// <base>.key, the key readable by the owner only.
+func writeKeyPair(base string, certDER []byte, key *ecdsa.PrivateKey) error {
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("failed to marshal key: %w", err)
+	}
+	if err := writePEM(base+".key", "EC PRIVATE KEY", keyDER, 0600); err != nil {
+		return err
+	}
+	return writePEM(base+".crt", "CERTIFICATE", certDER, 0644)
+}
+
+// loadCA reads the CA certificate and key written by ca init.
+func loadCA() (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	pair, err := tls.LoadX509KeyPair(filepath.Join(caDir, "ca.crt"), filepath.Join(caDir, "ca.key"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load the CA, run ca init first: %w", err)
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse the CA certificate: %w", err)
+	}
+	key, ok := pair.PrivateKey.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, nil, errors.New("the CA key is not an ECDSA key")
+	}
+	return cert, key, nil
+}
+
+// initCA creates the CA certificate and key, it never replaces an existing
+// CA since that would invalidate every issued certificate.
+func initCA() error {
+	if _, err := os.Stat(filepath.Join(caDir, "ca.crt")); err == nil {
+		return fmt.Errorf("a CA already exists in %s", caDir)
+	}
+	if err := os.MkdirAll(caDir, 0700); err != nil {
+		return fmt.Errorf("failed to create CA directory: %w", err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("failed to generate key: %w", err)
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          newSerial(),
+		Subject:               pkix.Name{CommonName: "paila-ingest CA", Organization: []string{"paila"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return fmt.Errorf("failed to create CA certificate: %w", err)
+	}
+	return writeKeyPair(filepath.Join(caDir, "ca"), der, key)
+}
+
+// issueCert signs a new certificate for cn with the CA and writes it as
+// <base>.crt and <base>.key. names become the DNS and IP subject alternative
+// names of a server certificate, client certificates only carry the CN.
+func issueCert(base string, cn string, names []string, usage x509.ExtKeyUsage) error {
+	caCert, caKey, err := loadCA()
+	if err != nil {
+		return err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("failed to generate key: %w", err)
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: newSerial(),
+		Subject:      pkix.Name{CommonName: cn, Organization: []string{"paila"}},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(certValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	for _, name := range names {
+		if ip := net.ParseIP(name); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, name)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		return fmt.Errorf("failed to create certificate: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(base), 0700); err != nil {
+		return fmt.Errorf("failed to create certificate directory: %w", err)
+	}
+	return writeKeyPair(base, der, key)
+}
+
+// caCommand runs the ca subcommand, e.g.
+//
+//	docker exec -it paila-ingest ./paila-ingest-go ca init
+//	docker exec -it paila-ingest ./paila-ingest-go ca server ingest.lan 10.0.0.5
+//	docker exec -it paila-ingest ./paila-ingest-go ca issue web01
+func caCommand(args []string) int {
+	usage := "Usage: paila-ingest-go ca init\n       paila-ingest-go ca server <name>...\n       paila-ingest-go ca issue <host>"
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, usage)
+		return 1
+	}
+
+	switch {
+	case args[0] == "init" && len(args) == 1:
+		if err := initCA(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Printf("Created the CA in %s\n", caDir)
+		fmt.Printf("Copy %s to the hosts to verify the server\n", filepath.Join(caDir, "ca.crt"))
+
+	case args[0] == "server" && len(args) > 1:
+		// the names the hosts use in the upload url
+		base := filepath.Join(caDir, "server")
+		if err := issueCert(base, args[1], args[1:], x509.ExtKeyUsageServerAuth); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Printf("Issued the server certificate %s.crt for %s\n", base, strings.Join(args[1:], ", "))
+
+	case args[0] == "issue" && len(args) == 2:
+		// the CN is checked against the host field of the uploads, so it
+		// must be a host uploadHandler accepts
+		host := args[1]
+		if err := validateHost(host); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		base := filepath.Join(caDir, "hosts", host)
+		if err := issueCert(base, host, nil, x509.ExtKeyUsageClientAuth); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Printf("Issued the client certificate of %s, copy these files to the host:\n\n", host)
+		fmt.Printf("  %s\n  %s.crt\n  %s.key\n\n", filepath.Join(caDir, "ca.crt"), base, base)
+		fmt.Printf("and run ./paila-logpush.sh -a ca.crt -c %s.crt -k %s.key\n", host, host)
+
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		return 1
+	}
+	return 0
+}
+
+// tlsConfig returns the server TLS config. with a client CA, certificates
+// issued by it are verified when the client sends one, and required when
+// "cert" is the only accepted auth mode.
+func tlsConfig(clientCA string) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if clientCA == "" {
+		return cfg, nil
+	}
+	pemData, err := os.ReadFile(clientCA)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pemData) {
+		return nil, fmt.Errorf("no certificates found in %s", clientCA)
+	}
+	cfg.ClientCAs = pool
+	cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	if len(authModes) == 1 && authModes[0] == "cert" {
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// validateHost checks the host form field, the stored name of the upload is
+// built from it and the date.
+func validateHost(host string) error {
+	if !hostReg.MatchString(host) || strings.Contains(host, "--") {
+		return fmt.Errorf("invalid host %q, use letters, digits, periods and single hyphens", host)
+	}
+	return nil
+}
+
+// validateDate checks the date form field is an ISO date.
+func validateDate(date string) error {
+	if t, err := time.Parse("2006-01-02", date); err != nil || t.Format("2006-01-02") != date {
+		return fmt.Errorf("invalid date %q, use YYYY-MM-DD", date)
+	}
+	return nil
+}
+
+// checkLogHeader makes sure the "= Host:" and "= Date:" header lines of the
+// logs file match the form fields, so a file can't be stored under the name
+// of another host or day. the file is rewound for the handler.
+func checkLogHeader(file io.ReadSeeker, host string, date string) error {
+	fileHost, fileDate := "", ""
+	scanner := bufio.NewScanner(file)
+	for i := 0; i < 20 && scanner.Scan(); i++ {
+		line := strings.TrimSpace(scanner.Text())
+		if m := logHostReg.FindStringSubmatch(line); m != nil && fileHost == "" {
+			fileHost = strings.TrimSpace(m[1])
+		}
+		if m := logDateReg.FindStringSubmatch(line); m != nil && fileDate == "" {
+			fileDate = strings.TrimSpace(m[1])
+		}
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("error reading file 'log': %w", err)
+	}
+
+	if fileHost == "" || fileDate == "" {
+		return errors.New("file 'log' has no '= Host:' and '= Date:' header lines")
+	}
+	if fileHost != host {
+		return fmt.Errorf("file 'log' is for host %q, not %q", fileHost, host)
+	}
+	if fileDate != date {
+		return fmt.Errorf("file 'log' is for date %q, not %q", fileDate, date)
+	}
+	return nil
+}
+
 // get the outbound up so we can output debug info on start
 func GetLocalOutboundIP() (string, error) {
 	// Dial a UDP connection to a well-known external address (e.g., Google DNS server).
@@ -57,31 +823,86 @@ func GetLocalOutboundIP() (string, error) {
 	return udpAddr.IP.String(), nil
 }
 
+// =============================================================================
+// upload response
+// every response of /uploadlog is a json object of version 1 of the schema
+// below, sent with the matching http status. "status" repeats the http status
+// as a string for paila-logpush.sh, which looks for "status":"201".
+//
+//	{
+//	  "version":  "1",
+//	  "status":   "201",                 http status
+//	  "error":    "invalid_date",        error code, only on errors
+//	  "message":  "...",                 human readable
+//	  "host":     "web01",               as far as known
+//	  "date":     "2026-10-17",
+//	  "filename": "web01--2026-10-17.logs.txt",
+//	  "filepath": "/.paila-ingest/uploads/web01--2026-10-17.logs.txt"
+//	}
+
+const responseVersion = "1"
+
+// the error codes of the upload response
+const (
+	ErrCodeMethodNotAllowed = "method_not_allowed" // 405 not a POST
+	ErrCodeBadRequest       = "bad_request"        // 400 malformed form or no 'log' file
+	ErrCodeInvalidHost      = "invalid_host"       // 400 host field can't be used as a name
+	ErrCodeInvalidDate      = "invalid_date"       // 400 date field is not YYYY-MM-DD
+	ErrCodeLogMismatch      = "log_mismatch"       // 400 header lines of the file disagree with the form
+	ErrCodeUnauthorized     = "unauthorized"       // 401 missing or invalid token, certificate or signature
+	ErrCodeTooLarge         = "too_large"          // 413 upload over the size limit
+	ErrCodeInternal         = "internal"           // 500 the file could not be stored or queued
+)
+
+// UploadResponse is the json body of every /uploadlog response.
+type UploadResponse struct {
+	Version  string `json:"version"`
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+	Message  string `json:"message"`
+	Host     string `json:"host,omitempty"`
+	Date     string `json:"date,omitempty"`
+	Filename string `json:"filename,omitempty"`
+	Filepath string `json:"filepath,omitempty"`
+}
+
+// writeUploadResponse sends resp with the http status.
+func writeUploadResponse(w http.ResponseWriter, status int, resp UploadResponse) {
+	resp.Version = responseVersion
+	resp.Status = strconv.Itoa(status)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
 // handler for the file upload
 func uploadHandler(w http.ResponseWriter, r *http.Request) {
 
+	// filled in as the request is validated, so errors carry what is known
+	response := UploadResponse{}
+	fail := func(status int, code string, message string) {
+		response.Error = code
+		response.Message = message
+		writeUploadResponse(w, status, response)
+	}
+
 	// make sure it is a post method
 	if r.Method != http.MethodPost {
-		// Prepare JSON response
-		response := map[string]string{
-			"status":  fmt.Sprintf("%d", http.StatusMethodNotAllowed),
-			"message": "Method not allowed",
-		}
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(response)
+		w.Header().Set("Allow", http.MethodPost)
+		fail(http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed, "Method not allowed")
 		return
 	}
 
-	// Parse the multipart form data
-	err := r.ParseMultipartForm(10 << 20) // 10 MB limit for form data
+	// Parse the multipart form data, up to maxUploadSize in total
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+	err := r.ParseMultipartForm(10 << 20) // 10 MB of it kept in memory
 	if err != nil {
-		// Prepare JSON response
-		response := map[string]string{
-			"status":  fmt.Sprintf("%d", http.StatusBadRequest),
-			"message": fmt.Sprintf("Error parsing multipart form: %v", err),
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			fail(http.StatusRequestEntityTooLarge, ErrCodeTooLarge, fmt.Sprintf("Upload larger than %d bytes", maxUploadSize))
+			return
 		}
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(response)
+		fail(http.StatusBadRequest, ErrCodeBadRequest, fmt.Sprintf("Error parsing multipart form: %v", err))
 		return
 	}
 
@@ -90,62 +911,62 @@ func uploadHandler(w http.ResponseWriter, r *http.Request) {
 	dateR := r.FormValue("date")
 
 	// sanitizing
-	// remove all non-alphanumeric characters except hyphens and periods
-	reg := regexp.MustCompile(`[^a-zA-Z0-9.-]`)
-	host := reg.ReplaceAllString(hostR, "")
-	date := reg.ReplaceAllString(dateR, "")
+	host := sanitizeReg.ReplaceAllString(hostR, "")
+	date := sanitizeReg.ReplaceAllString(dateR, "")
+	response.Host = host
+	response.Date = date
+
+	// the fields must be valid as sent, not only after sanitizing, since the
+	// stored name is derived from them
+	if err := validateHost(hostR); err != nil {
+		fail(http.StatusBadRequest, ErrCodeInvalidHost, fmt.Sprintf("Error validating form: %v", err))
+		return
+	}
+	if err := validateDate(dateR); err != nil {
+		fail(http.StatusBadRequest, ErrCodeInvalidDate, fmt.Sprintf("Error validating form: %v", err))
+		return
+	}
+	filename := host + "--" + date + ".logs.txt"
+
+	// the token is bound to the host, one host can't upload as another
+	if ok, reason := authorizeUpload(r, host, date); !ok {
+		fmt.Printf("Refused upload for %s from %s: %s\n", host, r.RemoteAddr, reason)
+		if authEnabled("token") {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="paila-ingest"`)
+		}
+		fail(http.StatusUnauthorized, ErrCodeUnauthorized, reason)
+		return
+	}
+	response.Filename = filename
 
 	// Get the "log" file
-	file, handler, err := r.FormFile("log")
-	if err != nil {
-		// Prepare JSON response
-		response := map[string]string{
-			"status":   fmt.Sprintf("%d", http.StatusInternalServerError),
-			"message":  fmt.Sprintf("Error retrieving file 'log': %v", err),
-			"filename": handler.Filename,
-			"host":     host,
-			"date":     date,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(response)
+	file, _, err := r.FormFile("log")
+	if err != nil {
+		fail(http.StatusBadRequest, ErrCodeBadRequest, fmt.Sprintf("Error retrieving file 'log': %v", err))
 		return
 	}
 	defer file.Close()
 
+	// the file must be the logs of the host and date it is stored as
+	if err := checkLogHeader(file, host, date); err != nil {
+		fail(http.StatusBadRequest, ErrCodeLogMismatch, fmt.Sprintf("Error validating file: %v", err))
+		return
+	}
+
 	// Create the directory if it doesn't exist
-	//uploadDir := "./uploads" // Define your upload directory
-	if _, err := os.Stat(uploadsDir); os.IsNotExist(err) {
-		err = os.Mkdir(uploadsDir, 0755)
-		if err != nil {
-			// Prepare JSON response
-			response := map[string]string{
-				"status":   fmt.Sprintf("%d", http.StatusInternalServerError),
-				"message":  fmt.Sprintf("Error creating upload directory: %v", err),
-				"filename": handler.Filename,
-				"host":     host,
-				"date":     date,
-			}
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(response)
-			return
-		}
+	if err := os.MkdirAll(uploadsDir, 0755); err != nil {
+		fmt.Printf("Error creating upload directory: %v\n", err)
+		fail(http.StatusInternalServerError, ErrCodeInternal, fmt.Sprintf("Error creating upload directory: %v", err))
+		return
 	}
 
 	// Create a new file on the filesystem to save the uploaded content
-	dstPath := filepath.Join(uploadsDir, handler.Filename)
+	dstPath := filepath.Join(uploadsDir, filename)
+	response.Filepath = dstPath
 	dst, err := os.Create(dstPath)
 	if err != nil {
-		// Prepare JSON response
-		response := map[string]string{
-			"status":   fmt.Sprintf("%d", http.StatusInternalServerError),
-			"message":  fmt.Sprintf("Error creating destination file: %v", err),
-			"filename": handler.Filename,
-			"host":     host,
-			"date":     date,
-			"filepath": dstPath,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(response)
+		fmt.Printf("Error creating destination file: %v\n", err)
+		fail(http.StatusInternalServerError, ErrCodeInternal, fmt.Sprintf("Error creating destination file: %v", err))
 		return
 	}
 	defer dst.Close()
@@ -153,42 +974,50 @@ func uploadHandler(w http.ResponseWriter, r *http.Request) {
 	// Copy the uploaded file content to the destination file
 	_, err = io.Copy(dst, file)
 	if err != nil {
-		// Prepare JSON response
-		response := map[string]string{
-			"status":   fmt.Sprintf("%d", http.StatusInternalServerError),
-			"message":  fmt.Sprintf("Error copying file content: %v", err),
-			"filename": handler.Filename,
-			"host":     host,
-			"date":     date,
-			"filepath": dstPath,
-		}
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(response)
+		fmt.Printf("Error copying file content: %v\n", err)
+		fail(http.StatusInternalServerError, ErrCodeInternal, fmt.Sprintf("Error copying file content: %v", err))
 		return
 	}
 
-	// Prepare JSON response
-	response := map[string]string{
-		"status":   "201",
-		"message":  "File uploaded successfully",
-		"filename": handler.Filename,
-		"host":     host,
-		"date":     date,
-		"filepath": dstPath,
+	// hand the upload over to the reporter for analysis
+	if err := dst.Close(); err != nil {
+		fmt.Printf("Error writing file content: %v\n", err)
+		fail(http.StatusInternalServerError, ErrCodeInternal, fmt.Sprintf("Error writing file content: %v", err))
+		return
+	}
+	// the file is kept, but without a job it never gets a report, so the
+	// client is told to push it again
+	if err := enqueueReport(host, date, filename); err != nil {
+		fmt.Printf("Error queueing report for %s--%s: %v\n", host, date, err)
+		fail(http.StatusInternalServerError, ErrCodeInternal, fmt.Sprintf("File stored but the report could not be queued: %v", err))
+		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+	response.Message = "File uploaded successfully"
+	writeUploadResponse(w, http.StatusCreated, response)
 
-	// todo : use go func to call to script that will handle parsing
-	//        sqlite database population, and the call to the
-	//        ai diagnostic tool api for the generated report
+	// todo : sqlite database population
 	// todo : this almost makes the setup for the dashboard to also
 	//        be on this server. *shrugs* makes sense to me
 
 }
 
 func main() {
+	// subcommands
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "token":
+			os.Exit(credentialCommand(tokenStore, os.Args[2:]))
+		case "secret":
+			os.Exit(credentialCommand(secretStore, os.Args[2:]))
+		case "ca":
+			os.Exit(caCommand(os.Args[2:]))
+		default:
+			fmt.Fprintf(os.Stderr, "Unknown command %q\n", os.Args[1])
+			os.Exit(1)
+		}
+	}
+
 	http.HandleFunc("/uploadlog", uploadHandler)
 	// get the ingest port from env variables if it exists
 	listenPortEnv, exists := os.LookupEnv("PAILA_INGEST_PORT")
@@ -196,12 +1025,71 @@ func main() {
 		listenPort = listenPortEnv
 	}
 
+	// get the upload size limit from env variables if set
+	if maxEnv, exists := os.LookupEnv("PAILA_INGEST_MAX_UPLOAD_MB"); exists {
+		mb, err := strconv.ParseInt(maxEnv, 10, 64)
+		if err != nil || mb <= 0 {
+			fmt.Fprintf(os.Stderr, "Invalid PAILA_INGEST_MAX_UPLOAD_MB %q\n", maxEnv)
+			os.Exit(1)
+		}
+		maxUploadSize = mb << 20
+	}
+
+	// get the accepted auth modes from env variables if set
+	if authEnv, exists := os.LookupEnv("PAILA_INGEST_AUTH"); exists {
+		authModes = nil
+		for _, m := range strings.Split(authEnv, ",") {
+			m = strings.ToLower(strings.TrimSpace(m))
+			if m != "token" && m != "cert" && m != "hmac" && m != "none" {
+				fmt.Fprintf(os.Stderr, "Unknown auth mode %q in PAILA_INGEST_AUTH\n", m)
+				os.Exit(1)
+			}
+			authModes = append(authModes, m)
+		}
+	}
+	if authEnabled("none") {
+		fmt.Println("Warning: PAILA_INGEST_AUTH allows anonymous uploads")
+	} else if tokens, err := tokenStore.load(); authEnabled("token") && err == nil && len(tokens) == 0 {
+		fmt.Println("No hosts enrolled yet, issue a token with: ./paila-ingest-go token issue <host>")
+	}
+
+	// serve TLS when a certificate is set, e.g. the ones of the ca subcommand
+	//   PAILA_INGEST_TLS_CERT=/.paila-ingest/ca/server.crt
+	//   PAILA_INGEST_TLS_KEY=/.paila-ingest/ca/server.key
+	//   PAILA_INGEST_TLS_CLIENT_CA=/.paila-ingest/ca/ca.crt
+	tlsCert := os.Getenv("PAILA_INGEST_TLS_CERT")
+	tlsKey := os.Getenv("PAILA_INGEST_TLS_KEY")
+	clientCA := os.Getenv("PAILA_INGEST_TLS_CLIENT_CA")
+	if (tlsCert == "") != (tlsKey == "") {
+		fmt.Fprintln(os.Stderr, "PAILA_INGEST_TLS_CERT and PAILA_INGEST_TLS_KEY must be set together")
+		os.Exit(1)
+	}
+	if authEnabled("cert") && (tlsCert == "" || clientCA == "") {
+		fmt.Fprintln(os.Stderr, "PAILA_INGEST_AUTH cert needs PAILA_INGEST_TLS_CERT, PAILA_INGEST_TLS_KEY and PAILA_INGEST_TLS_CLIENT_CA")
+		os.Exit(1)
+	}
+
 	ip, err := GetLocalOutboundIP()
 	if err != nil {
 		//log.Fatalf("Error getting local outbound IP: %v", err)
 	}
 
 	fmt.Println("Server listening on :" + listenPort)
-	fmt.Println("  ./paila-logpush.sh -u http://" + ip + ":" + listenPort + "/uploadlog")
-	http.ListenAndServe(":"+listenPort, nil)
+	if tlsCert == "" {
+		fmt.Println("  ./paila-logpush.sh -u http://" + ip + ":" + listenPort + "/uploadlog -t <token>")
+		http.ListenAndServe(":"+listenPort, nil)
+		return
+	}
+
+	cfg, err := tlsConfig(clientCA)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	server := &http.Server{Addr: ":" + listenPort, TLSConfig: cfg}
+	fmt.Println("  ./paila-logpush.sh -u https://" + ip + ":" + listenPort + "/uploadlog -a ca.crt -c <host>.crt -k <host>.key")
+	if err := server.ListenAndServeTLS(tlsCert, tlsKey); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,767 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// =============================================================================
+// host credentials
+
+// useTestTokens points the token store at a temporary file.
+func useTestTokens(t *testing.T) {
+	t.Helper()
+	file := tokenStore.file
+	tokenStore.file = filepath.Join(t.TempDir(), "tokens.json")
+	t.Cleanup(func() { tokenStore.file = file })
+}
+
+func TestCheckToken(t *testing.T) {
+	useTestTokens(t)
+	token, err := tokenStore.issue("web01", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// only the hash is kept
+	data, err := os.ReadFile(tokenStore.file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), token) || !strings.Contains(string(data), hashToken(token)) {
+		t.Errorf("token file %s, want the hash of the token only", data)
+	}
+
+	tests := []struct {
+		name  string
+		host  string
+		token string
+		want  bool
+	}{
+		{"issued token", "web01", token, true},
+		{"other token", "web01", tokenStore.newCredential(), false},
+		{"token of another host", "web02", token, false},
+		{"empty token", "web01", "", false},
+		{"hash as token", "web01", hashToken(token), false},
+	}
+	for _, tt := range tests {
+		if ok, err := checkToken(tt.host, tt.token); ok != tt.want || err != nil {
+			t.Errorf("%s: checkToken = %v, %v, want %v", tt.name, ok, err, tt.want)
+		}
+	}
+
+	// rotating replaces the old token right away
+	rotated, err := tokenStore.issue("web01", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := checkToken("web01", token); ok {
+		t.Error("old token still accepted after rotating")
+	}
+	if ok, _ := checkToken("web01", rotated); !ok {
+		t.Error("rotated token refused")
+	}
+
+	if err := tokenStore.revoke("web01"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := checkToken("web01", rotated); ok {
+		t.Error("token still accepted after revoking")
+	}
+}
+
+func TestTokenCommand(t *testing.T) {
+	useTestTokens(t)
+
+	// the steps run in order against the same token file
+	steps := []struct {
+		args  []string
+		want  int      // exit code
+		hosts []string // enrolled hosts afterwards
+	}{
+		{[]string{"list"}, 0, nil},
+		{[]string{"issue", "web01"}, 0, []string{"web01"}},
+		{[]string{"issue", "web01"}, 1, []string{"web01"}},
+		{[]string{"issue", "web--01"}, 1, []string{"web01"}},
+		{[]string{"issue", "../web01"}, 1, []string{"web01"}},
+		{[]string{"rotate", "web02"}, 1, []string{"web01"}},
+		{[]string{"issue", "web02"}, 0, []string{"web01", "web02"}},
+		{[]string{"rotate", "web01"}, 0, []string{"web01", "web02"}},
+		{[]string{"list"}, 0, []string{"web01", "web02"}},
+		{[]string{"revoke", "web01"}, 0, []string{"web02"}},
+		{[]string{"revoke", "web01"}, 1, []string{"web02"}},
+		{[]string{"renew", "web02"}, 1, []string{"web02"}},
+		{[]string{"issue"}, 1, []string{"web02"}},
+		{nil, 1, []string{"web02"}},
+	}
+	for _, step := range steps {
+		if got := credentialCommand(tokenStore, step.args); got != step.want {
+			t.Errorf("token %s = %d, want %d", strings.Join(step.args, " "), got, step.want)
+		}
+		tokens, err := tokenStore.load()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var hosts []string
+		for host := range tokens {
+			hosts = append(hosts, host)
+		}
+		sort.Strings(hosts)
+		if strings.Join(hosts, ",") != strings.Join(step.hosts, ",") {
+			t.Errorf("after token %s enrolled %v, want %v", strings.Join(step.args, " "), hosts, step.hosts)
+		}
+	}
+
+	tokens, _ := tokenStore.load()
+	if !tokens["web02"].RotatedAt.IsZero() || tokens["web02"].CreatedAt.IsZero() {
+		t.Errorf("web02 entry %+v, want created and never rotated", tokens["web02"])
+	}
+}
+
+// =============================================================================
+// signed uploads
+
+const testSecret = "00112233445566778899aabbccddeeff00112233445566778899aabbccddeeff"
+
+const testLogs = "\n============================================\n" +
+	"= Begin Logged Issues Report\n" +
+	"= Host: web01\n" +
+	"= Date: 2026-10-17\n" +
+	"============================================\n" +
+	"\n-- No Entries -- System is known to be in good health. --\n"
+
+// useTestSecrets points the secret store at a temporary file holding the
+// secret of web01 and forgets the used nonces.
+func useTestSecrets(t *testing.T) {
+	t.Helper()
+	file := secretStore.file
+	secretStore.file = filepath.Join(t.TempDir(), "secrets.json")
+	t.Cleanup(func() { secretStore.file = file })
+	if err := secretStore.save(map[string]Credential{"web01": {Secret: testSecret, CreatedAt: time.Now()}}); err != nil {
+		t.Fatal(err)
+	}
+	seenNoncesMu.Lock()
+	seenNonces = map[string]time.Time{}
+	seenNoncesMu.Unlock()
+}
+
+// testSign returns the signature paila-logpush.sh sends for the upload.
+func testSign(secret string, host string, date string, timestamp string, nonce string, body string) string {
+	key, _ := hex.DecodeString(secret)
+	bodyHash := sha256.Sum256([]byte(body))
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(signedPayload(host, date, timestamp, nonce, hex.EncodeToString(bodyHash[:]))))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// testUploadRequest returns a multipart upload request like the one of
+// paila-logpush.sh with the headers set.
+func testUploadRequest(t *testing.T, host string, date string, body string, headers map[string]string) *http.Request {
+	t.Helper()
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	mw.WriteField("host", host)
+	mw.WriteField("date", date)
+	fw, err := mw.CreateFormFile("log", host+"--"+date+".logs.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write([]byte(body))
+	mw.Close()
+
+	r := httptest.NewRequest(http.MethodPost, "/uploadlog", &buf)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	for k, v := range headers {
+		r.Header.Set(k, v)
+	}
+	return r
+}
+
+// testUpload returns a parsed multipart upload request with the headers set.
+func testUpload(t *testing.T, host string, date string, body string, headers map[string]string) *http.Request {
+	t.Helper()
+	r := testUploadRequest(t, host, date, body, headers)
+	if err := r.ParseMultipartForm(10 << 20); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// signedHeaders returns the signature headers for an upload of body.
+func signedHeaders(secret string, host string, date string, timestamp string, nonce string, body string) map[string]string {
+	return map[string]string{
+		timestampHeader: timestamp,
+		nonceHeader:     nonce,
+		signatureHeader: testSign(secret, host, date, timestamp, nonce, body),
+	}
+}
+
+func TestSignedPayload(t *testing.T) {
+	got := signedPayload("web01", "2026-10-17", "1792224000", "0123456789abcdef0123456789abcdef", "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855")
+	want := "paila-v1\nweb01\n2026-10-17\n1792224000\n0123456789abcdef0123456789abcdef\ne3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	if got != want {
+		t.Errorf("signedPayload = %q, want %q", got, want)
+	}
+}
+
+func TestCheckSignature(t *testing.T) {
+	now := time.Now().Unix()
+	ts := func(offset time.Duration) string {
+		return strconv.FormatInt(now+int64(offset/time.Second), 10)
+	}
+	nonce := "0123456789abcdef0123456789abcdef"
+
+	tests := []struct {
+		name    string
+		host    string // host and date of the form
+		date    string
+		body    string
+		headers map[string]string
+		want    bool
+		reason  string // part of the reason when refused
+	}{
+		{"valid", "web01", "2026-10-17", testLogs,
+			signedHeaders(testSecret, "web01", "2026-10-17", ts(0), nonce, testLogs), true, ""},
+		{"within the past skew", "web01", "2026-10-17", testLogs,
+			signedHeaders(testSecret, "web01", "2026-10-17", ts(-4*time.Minute), nonce+"1", testLogs), true, ""},
+		{"within the future skew", "web01", "2026-10-17", testLogs,
+			signedHeaders(testSecret, "web01", "2026-10-17", ts(4*time.Minute), nonce+"2", testLogs), true, ""},
+		{"stale", "web01", "2026-10-17", testLogs,
+			signedHeaders(testSecret, "web01", "2026-10-17", ts(-6*time.Minute), nonce+"3", testLogs), false, "too old"},
+		{"future", "web01", "2026-10-17", testLogs,
+			signedHeaders(testSecret, "web01", "2026-10-17", ts(6*time.Minute), nonce+"4", testLogs), false, "too old"},
+		{"bad timestamp", "web01", "2026-10-17", testLogs,
+			signedHeaders(testSecret, "web01", "2026-10-17", "yesterday", nonce+"5", testLogs), false, "Invalid timestamp"},
+		{"short nonce", "web01", "2026-10-17", testLogs,
+			signedHeaders(testSecret, "web01", "2026-10-17", ts(0), "abc", testLogs), false, "Invalid nonce"},
+		{"wrong secret", "web01", "2026-10-17", testLogs,
+			signedHeaders(strings.Repeat("ff", 32), "web01", "2026-10-17", ts(0), nonce+"6", testLogs), false, "Invalid signature"},
+		{"altered file", "web01", "2026-10-17", testLogs + "x",
+			signedHeaders(testSecret, "web01", "2026-10-17", ts(0), nonce+"7", testLogs), false, "Invalid signature"},
+		{"altered date", "web01", "2026-10-16", testLogs,
+			signedHeaders(testSecret, "web01", "2026-10-17", ts(0), nonce+"8", testLogs), false, "Invalid signature"},
+		{"unknown host", "web02", "2026-10-17", testLogs,
+			signedHeaders(testSecret, "web02", "2026-10-17", ts(0), nonce+"9", testLogs), false, "No secret"},
+		{"missing headers", "web01", "2026-10-17", testLogs, nil, false, "Missing signature headers"},
+	}
+
+	useTestSecrets(t)
+	for _, tt := range tests {
+		r := testUpload(t, tt.host, tt.date, tt.body, tt.headers)
+		ok, reason := checkSignature(r, tt.host, tt.date)
+		if ok != tt.want || !strings.Contains(reason, tt.reason) {
+			t.Errorf("%s: checkSignature = %v, %q, want %v, %q", tt.name, ok, reason, tt.want, tt.reason)
+		}
+	}
+}
+
+func TestCheckSignatureReplay(t *testing.T) {
+	useTestSecrets(t)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	nonce := "fedcba9876543210fedcba9876543210"
+	headers := signedHeaders(testSecret, "web01", "2026-10-17", timestamp, nonce, testLogs)
+
+	if ok, reason := checkSignature(testUpload(t, "web01", "2026-10-17", testLogs, headers), "web01", "2026-10-17"); !ok {
+		t.Fatalf("first upload refused: %s", reason)
+	}
+	ok, reason := checkSignature(testUpload(t, "web01", "2026-10-17", testLogs, headers), "web01", "2026-10-17")
+	if ok || !strings.Contains(reason, "Replayed") {
+		t.Errorf("replayed upload = %v, %q, want refused as replayed", ok, reason)
+	}
+
+	// a refused signature doesn't use up the nonce
+	nonce = "00000000000000000000000000000001"
+	bad := signedHeaders(strings.Repeat("ff", 32), "web01", "2026-10-17", timestamp, nonce, testLogs)
+	checkSignature(testUpload(t, "web01", "2026-10-17", testLogs, bad), "web01", "2026-10-17")
+	good := signedHeaders(testSecret, "web01", "2026-10-17", timestamp, nonce, testLogs)
+	if ok, reason := checkSignature(testUpload(t, "web01", "2026-10-17", testLogs, good), "web01", "2026-10-17"); !ok {
+		t.Errorf("upload after a refused one with the same nonce refused: %s", reason)
+	}
+}
+
+func TestCheckSignatureRewindsFile(t *testing.T) {
+	useTestSecrets(t)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	headers := signedHeaders(testSecret, "web01", "2026-10-17", timestamp, "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", testLogs)
+	r := testUpload(t, "web01", "2026-10-17", testLogs, headers)
+	if ok, reason := checkSignature(r, "web01", "2026-10-17"); !ok {
+		t.Fatalf("refused: %s", reason)
+	}
+	file, _, err := r.FormFile("log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var buf bytes.Buffer
+	buf.ReadFrom(file)
+	if buf.String() != testLogs {
+		t.Errorf("file read after the check = %q, want the whole file", buf.String())
+	}
+}
+
+// TestCheckSignatureLogpush signs an upload with the signing block of
+// paila-logpush.sh and checks the server accepts it.
+func TestCheckSignatureLogpush(t *testing.T) {
+	for _, tool := range []string{"bash", "openssl"} {
+		if _, err := exec.LookPath(tool); err != nil {
+			t.Skipf("%s not found", tool)
+		}
+	}
+	script, err := os.ReadFile("../../../paila-logpush.sh")
+	if err != nil {
+		t.Skip("paila-logpush.sh not found:", err)
+	}
+	start := strings.Index(string(script), "if [[ -n \"$SECRET\" ]]; then")
+	if start < 0 {
+		t.Fatal("signing block not found in paila-logpush.sh")
+	}
+	end := strings.Index(string(script[start:]), "\nfi\n")
+	if end < 0 {
+		t.Fatal("end of the signing block not found in paila-logpush.sh")
+	}
+	block := string(script[start : start+end+len("\nfi\n")])
+
+	logsPath := filepath.Join(t.TempDir(), "web01--2026-10-17.logs.txt")
+	if err := os.WriteFile(logsPath, []byte(testLogs), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("bash", "-c", "CURLAUTH=()\n"+block+"printf '%s\\n' \"${CURLAUTH[@]}\"\n")
+	cmd.Env = append(os.Environ(), "HOST=web01", "DATE_S=2026-10-17", "OUTPUTPATH="+logsPath, "SECRET="+testSecret)
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("signing block failed: %v", err)
+	}
+
+	// the curl arguments are pairs of -H and "Name: value"
+	headers := map[string]string{}
+	args := strings.Split(strings.TrimSpace(string(out)), "\n")
+	for i := 0; i+1 < len(args); i += 2 {
+		if args[i] != "-H" {
+			t.Fatalf("unexpected curl argument %q", args[i])
+		}
+		name, value, _ := strings.Cut(args[i+1], ": ")
+		headers[name] = value
+	}
+	if len(headers) != 3 {
+		t.Fatalf("got headers %v, want timestamp, nonce and signature", headers)
+	}
+
+	useTestSecrets(t)
+	if ok, reason := checkSignature(testUpload(t, "web01", "2026-10-17", testLogs, headers), "web01", "2026-10-17"); !ok {
+		t.Errorf("upload signed by paila-logpush.sh refused: %s", reason)
+	}
+}
+
+// =============================================================================
+// upload authorization
+
+func TestAuthorizeUpload(t *testing.T) {
+	useTestTokens(t)
+	useTestSecrets(t)
+	token, err := tokenStore.issue("web01", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modes := authModes
+	t.Cleanup(func() { authModes = modes })
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	nonce := 0
+	// a fresh signature for every upload, the nonces can't be reused
+	signed := func(secret string) map[string]string {
+		nonce++
+		return signedHeaders(secret, "web01", "2026-10-17", timestamp, fmt.Sprintf("%032x", nonce), testLogs)
+	}
+	withToken := func(token string, headers map[string]string) map[string]string {
+		if headers == nil {
+			headers = map[string]string{}
+		}
+		headers["Authorization"] = "Bearer " + token
+		return headers
+	}
+	badSecret := strings.Repeat("ff", 32)
+	badToken := tokenStore.newCredential()
+
+	tests := []struct {
+		name    string
+		modes   []string
+		headers map[string]string
+		want    bool
+		reason  string // part of the reason when refused
+	}{
+		{"none", []string{"none"}, nil, true, ""},
+		{"token", []string{"token"}, withToken(token, nil), true, ""},
+		{"lowercase bearer", []string{"token"}, map[string]string{"Authorization": "bearer " + token}, true, ""},
+		{"wrong token", []string{"token"}, withToken(badToken, nil), false, "Invalid token"},
+		{"no token", []string{"token"}, nil, false, "Missing token"},
+		{"token when only hmac", []string{"hmac"}, withToken(token, nil), false, "Missing signature"},
+		{"signature", []string{"hmac"}, signed(testSecret), true, ""},
+		{"signature when only token", []string{"token"}, signed(testSecret), false, "Missing token"},
+		{"token and hmac, token", []string{"token", "hmac"}, withToken(token, nil), true, ""},
+		{"token and hmac, signature", []string{"token", "hmac"}, signed(testSecret), true, ""},
+		// a stale token doesn't shadow a valid signature, and the other way round
+		{"wrong token, valid signature", []string{"token", "hmac"}, withToken(badToken, signed(testSecret)), true, ""},
+		{"valid token, wrong signature", []string{"token", "hmac"}, withToken(token, signed(badSecret)), true, ""},
+		{"wrong token, wrong signature", []string{"token", "hmac"}, withToken(badToken, signed(badSecret)), false, "Invalid token for host web01, Invalid signature"},
+		{"nothing", []string{"token", "hmac"}, nil, false, "Missing token or signature"},
+	}
+	for _, tt := range tests {
+		authModes = tt.modes
+		r := testUpload(t, "web01", "2026-10-17", testLogs, tt.headers)
+		ok, reason := authorizeUpload(r, "web01", "2026-10-17")
+		if ok != tt.want || !strings.Contains(reason, tt.reason) {
+			t.Errorf("%s: authorizeUpload = %v, %q, want %v, %q", tt.name, ok, reason, tt.want, tt.reason)
+		}
+	}
+}
+
+// =============================================================================
+// upload validation
+
+func TestValidateHost(t *testing.T) {
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{"web01", true},
+		{"web-01.example.com", true},
+		{"a", true},
+		{"", false},
+		{"web--01", false},
+		{"-web01", false},
+		{"web01-", false},
+		{".web01", false},
+		{"web/01", false},
+		{"../web01", false},
+		{"web 01", false},
+		{"web_01", false},
+	}
+	for _, tt := range tests {
+		if err := validateHost(tt.host); (err == nil) != tt.want {
+			t.Errorf("validateHost(%q) = %v, want valid %v", tt.host, err, tt.want)
+		}
+	}
+}
+
+func TestValidateDate(t *testing.T) {
+	tests := []struct {
+		date string
+		want bool
+	}{
+		{"2026-10-17", true},
+		{"2028-02-29", true},
+		{"2026-02-29", false},
+		{"2026-13-01", false},
+		{"2026-10-32", false},
+		{"2026-1-7", false},
+		{"17.10.2026", false},
+		{"2026-10-17T00:00:00Z", false},
+		{"20261017", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if err := validateDate(tt.date); (err == nil) != tt.want {
+			t.Errorf("validateDate(%q) = %v, want valid %v", tt.date, err, tt.want)
+		}
+	}
+}
+
+func TestCheckLogHeader(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		host    string
+		date    string
+		wantErr string // empty when the header matches
+	}{
+		{"matching", testLogs, "web01", "2026-10-17", ""},
+		{"crlf line endings", strings.ReplaceAll(testLogs, "\n", "\r\n"), "web01", "2026-10-17", ""},
+		{"other host", testLogs, "web02", "2026-10-17", `for host "web01"`},
+		{"other date", testLogs, "web01", "2026-10-16", `for date "2026-10-17"`},
+		{"no header", "just some log lines\n", "web01", "2026-10-17", "no '= Host:'"},
+		{"no date line", "= Host: web01\n", "web01", "2026-10-17", "no '= Host:'"},
+		{"header too far down", strings.Repeat("x\n", 30) + testLogs, "web01", "2026-10-17", "no '= Host:'"},
+		{"empty", "", "web01", "2026-10-17", "no '= Host:'"},
+		// only the first header counts, the system information report repeats it
+		{"first header wins", testLogs + "= Host: web02\n", "web01", "2026-10-17", ""},
+	}
+	for _, tt := range tests {
+		file := strings.NewReader(tt.content)
+		err := checkLogHeader(file, tt.host, tt.date)
+		if tt.wantErr == "" && err != nil {
+			t.Errorf("%s: checkLogHeader = %v, want no error", tt.name, err)
+		}
+		if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("%s: checkLogHeader = %v, want an error containing %q", tt.name, err, tt.wantErr)
+		}
+		// the file is rewound for the handler
+		if pos, _ := file.Seek(0, 1); pos != 0 {
+			t.Errorf("%s: file left at offset %d", tt.name, pos)
+		}
+	}
+}
+
+// =============================================================================
+// upload response
+
+// useTestDirs points the uploads and queue folders at temporary folders and
+// sets the accepted auth modes for the test.
+func useTestDirs(t *testing.T, modes ...string) {
+	t.Helper()
+	uploads, queue, auth, maxSize := uploadsDir, queueDir, authModes, maxUploadSize
+	t.Cleanup(func() { uploadsDir, queueDir, authModes, maxUploadSize = uploads, queue, auth, maxSize })
+	dir := t.TempDir()
+	uploadsDir = filepath.Join(dir, "uploads")
+	queueDir = filepath.Join(dir, "queue")
+	authModes = modes
+}
+
+func TestUploadHandler(t *testing.T) {
+	noLog := func(t *testing.T) *http.Request {
+		var buf bytes.Buffer
+		mw := multipart.NewWriter(&buf)
+		mw.WriteField("host", "web01")
+		mw.WriteField("date", "2026-10-17")
+		mw.Close()
+		r := httptest.NewRequest(http.MethodPost, "/uploadlog", &buf)
+		r.Header.Set("Content-Type", mw.FormDataContentType())
+		return r
+	}
+
+	tests := []struct {
+		name       string
+		modes      []string
+		maxSize    int64 // 0 keeps the default
+		queueFails bool  // the queue folder can't be created
+		req        func(t *testing.T) *http.Request
+		wantStatus int
+		wantCode   string // error code, empty on success
+	}{
+		{"stored", []string{"none"}, 0, false,
+			func(t *testing.T) *http.Request { return testUploadRequest(t, "web01", "2026-10-17", testLogs, nil) },
+			http.StatusCreated, ""},
+		{"not a post", []string{"none"}, 0, false,
+			func(t *testing.T) *http.Request { return httptest.NewRequest(http.MethodGet, "/uploadlog", nil) },
+			http.StatusMethodNotAllowed, ErrCodeMethodNotAllowed},
+		{"not a multipart form", []string{"none"}, 0, false,
+			func(t *testing.T) *http.Request {
+				return httptest.NewRequest(http.MethodPost, "/uploadlog", strings.NewReader("host=web01"))
+			},
+			http.StatusBadRequest, ErrCodeBadRequest},
+		{"no log file", []string{"none"}, 0, false, noLog,
+			http.StatusBadRequest, ErrCodeBadRequest},
+		{"invalid host", []string{"none"}, 0, false,
+			func(t *testing.T) *http.Request { return testUploadRequest(t, "web--01", "2026-10-17", testLogs, nil) },
+			http.StatusBadRequest, ErrCodeInvalidHost},
+		{"invalid date", []string{"none"}, 0, false,
+			func(t *testing.T) *http.Request { return testUploadRequest(t, "web01", "2026-13-01", testLogs, nil) },
+			http.StatusBadRequest, ErrCodeInvalidDate},
+		{"logs of another host", []string{"none"}, 0, false,
+			func(t *testing.T) *http.Request { return testUploadRequest(t, "web02", "2026-10-17", testLogs, nil) },
+			http.StatusBadRequest, ErrCodeLogMismatch},
+		{"no token", []string{"token"}, 0, false,
+			func(t *testing.T) *http.Request { return testUploadRequest(t, "web01", "2026-10-17", testLogs, nil) },
+			http.StatusUnauthorized, ErrCodeUnauthorized},
+		{"too large", []string{"none"}, 1024, false,
+			func(t *testing.T) *http.Request {
+				return testUploadRequest(t, "web01", "2026-10-17", testLogs+strings.Repeat("x", 2048), nil)
+			},
+			http.StatusRequestEntityTooLarge, ErrCodeTooLarge},
+		{"not queued", []string{"none"}, 0, true,
+			func(t *testing.T) *http.Request { return testUploadRequest(t, "web01", "2026-10-17", testLogs, nil) },
+			http.StatusInternalServerError, ErrCodeInternal},
+	}
+
+	for _, tt := range tests {
+		useTestDirs(t, tt.modes...)
+		if tt.maxSize > 0 {
+			maxUploadSize = tt.maxSize
+		}
+		if tt.queueFails {
+			// a file where the folder should be
+			os.WriteFile(queueDir, nil, 0644)
+		}
+
+		w := httptest.NewRecorder()
+		uploadHandler(w, tt.req(t))
+
+		if w.Code != tt.wantStatus {
+			t.Errorf("%s: status %d, want %d: %s", tt.name, w.Code, tt.wantStatus, w.Body.String())
+			continue
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%s: content type %q", tt.name, ct)
+		}
+		// paila-logpush.sh looks for this text, not the parsed json
+		if got := strings.Contains(w.Body.String(), `"status":"201"`); got != (tt.wantStatus == http.StatusCreated) {
+			t.Errorf("%s: body %s, want \"status\":\"201\" only on success", tt.name, w.Body.String())
+		}
+		var resp UploadResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Errorf("%s: body is not json: %v", tt.name, err)
+			continue
+		}
+		if resp.Version != "1" || resp.Status != strconv.Itoa(tt.wantStatus) || resp.Error != tt.wantCode || resp.Message == "" {
+			t.Errorf("%s: response %+v, want version 1, status %d and error %q", tt.name, resp, tt.wantStatus, tt.wantCode)
+		}
+
+		switch tt.wantStatus {
+		case http.StatusCreated:
+			if resp.Host != "web01" || resp.Date != "2026-10-17" || resp.Filename != "web01--2026-10-17.logs.txt" || resp.Filepath != filepath.Join(uploadsDir, resp.Filename) {
+				t.Errorf("%s: response %+v", tt.name, resp)
+			}
+			if stored, err := os.ReadFile(resp.Filepath); err != nil || string(stored) != testLogs {
+				t.Errorf("%s: stored file %q, %v", tt.name, stored, err)
+			}
+			if jobs, _ := filepath.Glob(filepath.Join(queueDir, "*.job.json")); len(jobs) != 1 {
+				t.Errorf("%s: %d jobs queued, want 1", tt.name, len(jobs))
+			}
+		case http.StatusMethodNotAllowed:
+			if allow := w.Header().Get("Allow"); allow != http.MethodPost {
+				t.Errorf("%s: Allow %q", tt.name, allow)
+			}
+		case http.StatusUnauthorized:
+			if w.Header().Get("WWW-Authenticate") == "" {
+				t.Errorf("%s: no WWW-Authenticate header", tt.name)
+			}
+		case http.StatusInternalServerError:
+			// the file is stored, only the job is missing
+			if _, err := os.Stat(resp.Filepath); resp.Filepath == "" || err != nil {
+				t.Errorf("%s: expected the upload to be stored, response %+v", tt.name, resp)
+			}
+		}
+	}
+}
+
+// =============================================================================
+// certificate authority
+
+// useTestCA creates a CA in a temporary folder with a server certificate for
+// 127.0.0.1 and a client certificate for web01.
+func useTestCA(t *testing.T) {
+	t.Helper()
+	dir := caDir
+	caDir = t.TempDir()
+	t.Cleanup(func() { caDir = dir })
+	if err := initCA(); err != nil {
+		t.Fatal(err)
+	}
+	if err := issueCert(filepath.Join(caDir, "server"), "127.0.0.1", []string{"127.0.0.1"}, x509.ExtKeyUsageServerAuth); err != nil {
+		t.Fatal(err)
+	}
+	if err := issueCert(filepath.Join(caDir, "hosts", "web01"), "web01", nil, x509.ExtKeyUsageClientAuth); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientCertificate(t *testing.T) {
+	useTestCA(t)
+	useTestDirs(t, "cert")
+
+	// the server as main sets it up with PAILA_INGEST_AUTH=cert
+	cfg, err := tlsConfig(filepath.Join(caDir, "ca.crt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverCert, err := tls.LoadX509KeyPair(filepath.Join(caDir, "server.crt"), filepath.Join(caDir, "server.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Certificates = []tls.Certificate{serverCert}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(uploadHandler))
+	srv.TLS = cfg
+	srv.StartTLS()
+	defer srv.Close()
+
+	// the client as paila-logpush.sh -a ca.crt -c web01.crt -k web01.key
+	caPEM, err := os.ReadFile(filepath.Join(caDir, "ca.crt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(caPEM)
+	clientCert, err := tls.LoadX509KeyPair(filepath.Join(caDir, "hosts", "web01.crt"), filepath.Join(caDir, "hosts", "web01.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a certificate for web01 from a CA the server doesn't know
+	ownCA := caDir
+	caDir = t.TempDir()
+	if err := initCA(); err != nil {
+		t.Fatal(err)
+	}
+	if err := issueCert(filepath.Join(caDir, "web01"), "web01", nil, x509.ExtKeyUsageClientAuth); err != nil {
+		t.Fatal(err)
+	}
+	foreignCert, err := tls.LoadX509KeyPair(filepath.Join(caDir, "web01.crt"), filepath.Join(caDir, "web01.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	caDir = ownCA
+
+	client := func(certs ...tls.Certificate) *http.Client {
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certs}}}
+	}
+	upload := func(c *http.Client, host string) (*http.Response, error) {
+		logs := strings.Replace(testLogs, "= Host: web01", "= Host: "+host, 1)
+		r := testUploadRequest(t, host, "2026-10-17", logs, nil)
+		req, err := http.NewRequest(http.MethodPost, srv.URL+"/uploadlog", r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header = r.Header
+		return c.Do(req)
+	}
+
+	tests := []struct {
+		name       string
+		client     *http.Client
+		host       string
+		wantStatus int // 0 when the handshake fails
+	}{
+		{"matching CN", client(clientCert), "web01", http.StatusCreated},
+		{"other CN", client(clientCert), "web02", http.StatusUnauthorized},
+		{"no certificate", client(), "web01", 0},
+		{"certificate of another CA", client(foreignCert), "web01", 0},
+	}
+	for _, tt := range tests {
+		resp, err := upload(tt.client, tt.host)
+		if tt.wantStatus == 0 {
+			if err == nil {
+				resp.Body.Close()
+				t.Errorf("%s: got status %d, want the handshake to fail", tt.name, resp.StatusCode)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		var body UploadResponse
+		json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+		if resp.StatusCode != tt.wantStatus {
+			t.Errorf("%s: status %d, want %d: %+v", tt.name, resp.StatusCode, tt.wantStatus, body)
+		}
+		if tt.wantStatus == http.StatusUnauthorized && !strings.Contains(body.Message, "Client certificate of web01 does not match host web02") {
+			t.Errorf("%s: message %q", tt.name, body.Message)
+		}
+	}
+}
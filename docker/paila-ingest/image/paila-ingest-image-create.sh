@@ -40,6 +40,7 @@ sudo docker exec -it paila-ingest-image mkdir .paila-ingest
 sudo docker exec -it paila-ingest-image mkdir .paila-ingest/uploads
 sudo docker exec -it paila-ingest-image mkdir .paila-ingest/reports
 sudo docker exec -it paila-ingest-image mkdir .paila-ingest/archive
+sudo docker exec -it paila-ingest-image mkdir .paila-ingest/queue
 
 
 # copy ingest server go binary and other files into place
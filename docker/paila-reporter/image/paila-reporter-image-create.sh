@@ -40,6 +40,7 @@ sudo docker exec -it paila-reporter-image mkdir .paila-ingest
 sudo docker exec -it paila-reporter-image mkdir .paila-ingest/uploads
 sudo docker exec -it paila-reporter-image mkdir .paila-ingest/reports
 sudo docker exec -it paila-reporter-image mkdir .paila-ingest/archive
+sudo docker exec -it paila-reporter-image mkdir .paila-ingest/queue
 
 
 # copy reporter server go binary and other files into place
@@ -50,6 +51,9 @@ sudo docker exec -it paila-reporter-image mkdir .paila-reporter/public
 #
 for f in public/*; do sudo docker cp $f paila-reporter-image:.paila-reporter/public/; done
 
+# optional reporter configuration (model options, host groups)
+#sudo docker cp paila-reporter-config.example.json paila-reporter-image:.paila-reporter/config.json
+
 
 # test server
 #sudo docker exec -it paila-reporter-image ./paila-reporter-go
@@ -15,7 +15,25 @@ function hostmap_ui(o){
 
 
 
-function hostmap_ui_update(){
+// hostmap_ui_report_meta describes the model, prompts and timings recorded
+// with a report
+function hostmap_ui_report_meta(meta){
+    var u = meta.usage || {};
+    var parts = [
+        'Model: '+escapeHtml(meta.model)+(meta.model_digest ? ' ('+escapeHtml(meta.model_digest.replace(/^sha256:/,'').substring(0,12))+')' : ''),
+        'Backend: '+escapeHtml(meta.backend+' '+meta.backend_url),
+        'Prompt: v'+meta.prompt_version+' '+escapeHtml((meta.prompt_hash || '').replace(/^sha256:/,'').substring(0,12)),
+        'Tokens: '+(u.prompt_eval_count || 0)+' in, '+(u.eval_count || 0)+' out'+(u.calls > 1 ? ' over '+u.calls+' calls' : ''),
+        'Time: '+((u.wall_duration || 0)/1e9).toFixed(1)+'s'
+    ];
+    if(meta.generated_at){
+        parts.push('Generated: '+escapeHtml(new Date(meta.generated_at).toLocaleString()));
+    }
+    return parts.join(' &middot; ');
+}
+
+// version selects a report of the history, the latest one when empty
+function hostmap_ui_update(version){
     document.getElementById('paila_log_content').innerHTML = '';
     var h = document.getElementById('select-host').value;
     var d = document.getElementById('select-date').value;
@@ -27,7 +45,10 @@ function hostmap_ui_update(){
 
     window.location.hash = '#?host='+encodeURIComponent(h)+'&date='+encodeURIComponent(d)+''
 
-    const url = '/report-data?host='+encodeURIComponent(h)+'&date='+encodeURIComponent(d)+''; // Replace with your actual API endpoint
+    var url = '/report-data?host='+encodeURIComponent(h)+'&date='+encodeURIComponent(d)+''; // Replace with your actual API endpoint
+    if(version){
+        url += '&version='+encodeURIComponent(version);
+    }
 
     // Use the Fetch API to make a GET request
     fetch(url)
@@ -50,15 +71,49 @@ function hostmap_ui_update(){
                 dataReport=markdownToHtml(dataReport)+"<div style=\"text-align:right;padding:42px;\"><button onclick=\"hostmap_ui_generate()\">Regenerate Report</button></div>"
             }
 
+            // how the report was produced
+            if(data.report!="" && data.meta && data.meta.model){
+                dataReport += '<div class="report-meta">'+hostmap_ui_report_meta(data.meta)+'</div>';
+            }
+
+            // let the reader know when the input had to be cut down for the model
+            if(data.report!="" && data.meta && data.meta.truncation){
+                var t = data.meta.truncation;
+                dataReport = "<div class=\"report-notice\">"+t.omitted_lines+" log lines ("+
+                    Object.entries(t.omitted_by_severity).map(([k,v]) => v+" "+escapeHtml(k)).join(", ")+
+                    ") were omitted to fit the token budget of "+t.budget_tokens+" tokens.</div>"+dataReport;
+            }
+
+            // warn when the logs tried to instruct the model or the report drifted from its structure
+            if(data.report!="" && data.meta && data.meta.flagged && data.meta.security){
+                var sec = data.meta.security;
+                var items = (sec.injection_matches || []).map(m => "<li>suspicious log line: <code>"+escapeHtml(m)+"</code></li>");
+                items = items.concat((sec.structure_problems || []).map(m => "<li>"+escapeHtml(m)+"</li>"));
+                dataReport = "<div class=\"report-notice report-flagged\"><strong>This report is flagged for review.</strong> "+
+                    "The logs may contain text written to steer the analysis, verify the findings against the logs.<ul>"+items.join("")+"</ul></div>"+dataReport;
+            }
+
+            // switch between the versions kept in the report history
+            if(data.versions && data.versions.length > 1){
+                var current = data.version || data.versions[0].version;
+                var opts = data.versions.map((v) => '<option value="'+v.version+'"'+(v.version==current ? ' selected' : '')+'>'+
+                    'Version '+v.version+(v.generated_at ? ' - '+escapeHtml(new Date(v.generated_at).toLocaleString()) : '')+
+                    (v.model ? ' - '+escapeHtml(v.model) : '')+(v.flagged ? ' (flagged)' : '')+(v.version==data.versions[0].version ? ' (latest)' : '')+'</option>').join('');
+                dataReport = '<div class="report-versions"><label for="select-version">Report:</label> '+
+                    '<select id="select-version" onchange="hostmap_ui_update(this.value)">'+opts+'</select></div>'+dataReport;
+            }
+
 
 
 
             document.getElementById('paila_log_content').innerHTML = '<div><span>'+data.host+' : '+data.date+'</span> &nbsp; '+
                 '<span id="paila_content_tab_report" onclick="hostmap_ui_tab(\'report\')">Report</span> &nbsp;'+
+                '<span id="paila_content_tab_findings" onclick="hostmap_ui_tab(\'findings\')">Findings</span> &nbsp;'+
                 '<span id="paila_content_tab_logs" onclick="hostmap_ui_tab(\'logs\')">Logs</span> &nbsp; '+
                 '<span id="paila_content_tab_specs" onclick="hostmap_ui_tab(\'specs\')">Specs</span></div>'+
                 '<div id="paila_log_tab_content">'+
                 '<div id="paila_content_report">'+dataReport+'</div>'+
+                '<div id="paila_content_findings">'+hostmap_ui_findings(data.findings)+'</div>'+
                 '<div id="paila_content_logs"><pre>'+escapeHtml(data.logs)+'</pre></div>'+
                 '<div id="paila_content_specs"><pre>'+escapeHtml(data.specs)+'</pre></div>'+
                 '</div>';
@@ -76,6 +131,34 @@ function hostmap_ui_update(){
 
 
 
+// render the structured findings of a report as a table, most severe first
+function hostmap_ui_findings(f){
+    if(!f || !f.findings){
+        return "<div class=\"no-report-message-generate\">No Findings</div>";
+    }
+    if(f.findings.length == 0){
+        return "<div class=\"no-report-message-generate\">No issues found</div>";
+    }
+    const order = ["critical", "high", "medium", "low", "info"];
+    var list = f.findings.slice().sort((a, b) => order.indexOf(a.severity) - order.indexOf(b.severity));
+
+    var counts = {};
+    list.forEach((x) => { counts[x.severity] = (counts[x.severity] || 0) + 1; });
+    var h = '<div class="findings-summary">'+order.filter(s => counts[s]).map(s => '<span class="severity severity-'+s+'">'+counts[s]+' '+s+'</span>').join(' ')+'</div>';
+
+    h += '<table class="findings"><tr><th>Severity</th><th>Finding</th><th>Component</th><th>Probable Cause</th><th>Resolution</th></tr>';
+    list.forEach((x) => {
+        h += '<tr><td><span class="severity severity-'+escapeHtml(x.severity)+'">'+escapeHtml(x.severity)+'</span></td>'+
+            '<td>'+escapeHtml(x.title)+(x.evidence.length ? '<pre>'+escapeHtml(x.evidence.join("\n"))+'</pre>' : '')+'</td>'+
+            '<td>'+escapeHtml(x.component)+'</td>'+
+            '<td>'+escapeHtml(x.probable_cause)+'</td>'+
+            '<td>'+escapeHtml(x.resolution)+'</td></tr>';
+    });
+    return h+'</table>';
+}
+
+
+
 function escapeHtml(text) {
   var map = {
     '&': '&amp;',
@@ -94,10 +177,12 @@ function hostmap_ui_tab(t){
     document.getElementById('paila_content_logs').style.display = 'none';
     document.getElementById('paila_content_specs').style.display = 'none';
     document.getElementById('paila_content_report').style.display = 'none';
+    document.getElementById('paila_content_findings').style.display = 'none';
 
     document.getElementById('paila_content_tab_logs').style.opacity = '0.42';
     document.getElementById('paila_content_tab_specs').style.opacity = '0.42';
     document.getElementById('paila_content_tab_report').style.opacity = '0.42';
+    document.getElementById('paila_content_tab_findings').style.opacity = '0.42';
 
     if(t =="logs"){
         document.getElementById('paila_content_logs').style.display = 'block';
@@ -111,6 +196,10 @@ function hostmap_ui_tab(t){
         document.getElementById('paila_content_report').style.display = 'block';
         document.getElementById('paila_content_tab_report').style.opacity = '1';
     }
+    if(t =="findings"){
+        document.getElementById('paila_content_findings').style.display = 'block';
+        document.getElementById('paila_content_tab_findings').style.opacity = '1';
+    }
 
     /*
     switch (t) {
@@ -129,31 +218,41 @@ function hostmap_ui_tab(t){
 
 
 
-async function hostmap_ui_generate(){
+// force generates a new version even when the logs, prompts and model
+// options are unchanged since the latest report
+async function hostmap_ui_generate(force){
     var h = document.getElementById('select-host').value;
     var d = document.getElementById('select-date').value;
     if(h=="" || d==""){
         return;
     }
-    document.getElementById('paila_content_report').innerHTML = "<div class=\"no-report-message-generate\">&nbsp;<br /><br />Generating ...</div>";
+    document.getElementById('paila_content_report').innerHTML = "<div class=\"no-report-message-generate\">&nbsp;<br /><br />Queueing ...</div>";
 
     //var u = 'http://localhost/report-generate?host='+encodeURIComponent(h)+'&date='+encodeURIComponent(d)+''
     var u = '/report-generate?host='+encodeURIComponent(h)+'&date='+encodeURIComponent(d)+''
+    if(force){
+        u += '&force=1';
+    }
 
     try {
-        const response = await fetch(u);
-        if (!response.ok) {
-            throw new Error(`Response status: ${response.status}`);
-            //console.log(response);
-            // reload get
-            document.getElementById('paila_content_report').innerHTML = '<pre>!OK</pre>';
+        // the report is generated in the background, the response only carries the job id
+        const response = await fetch(u, { method: 'POST' });
+        const json = await response.json();
+        if (!response.ok || json.success != "1") {
+            throw new Error(json.message || `Response status: ${response.status}`);
+        }
+        // nothing changed since the latest report, it is kept as is
+        if(json.cached == "1"){
+            document.getElementById('paila_content_report').innerHTML = "<div class=\"no-report-message-generate\">The logs, prompts and model options are unchanged since version "+
+                escapeHtml(json.version)+", the report was not generated again.<br /><br /><button onclick=\"hostmap_ui_generate(true)\">Regenerate Anyway</button> "+
+                "<button onclick=\"hostmap_ui_update()\">Show Report</button></div>";
+            return;
+        }
+        if(window.EventSource){
+            hostmap_ui_job_follow(json.job_id, h, d);
+        } else {
+            hostmap_ui_job_poll(json.job_id, h, d);
         }
-        document.getElementById('paila_content_report').innerHTML = '<pre>OK</pre>';
-        //if(response) // "success":"1"
-        //const json = await response.json();
-        console.log(response);
-        //document.getElementById('paila_content_report').innerHTML = '<pre>'+escapeHtml(response)+'</pre>';
-        hostmap_ui_update()
     } catch (error) {
         document.getElementById('paila_content_report').innerHTML = '<pre>'+escapeHtml(error.message)+'</pre>';
         setTimeout(hostmap_ui_update,1500);
@@ -163,6 +262,131 @@ async function hostmap_ui_generate(){
 
 
 
+// follow the job over server-sent events, rendering the report text as the
+// model streams it, then reload the report when the job has finished
+function hostmap_ui_job_follow(id, h, d){
+    var el = document.getElementById('paila_content_report');
+    var text = '';
+    const source = new EventSource('/report-jobs/'+encodeURIComponent(id)+'/events');
+
+    // stop following when the user switched to another host or date
+    function current(){
+        if(document.getElementById('select-host').value != h || document.getElementById('select-date').value != d){
+            source.close();
+            return false;
+        }
+        return true;
+    }
+
+    function render(){
+        el.innerHTML = markdownToHtml(escapeHtml(text))+"<div class=\"no-report-message-generate\"><progress></progress><br /><br />"+hostmap_ui_job_cancel_button(id)+"</div>";
+    }
+
+    source.addEventListener('state', function(e){
+        if(!current()){ return; }
+        hostmap_ui_job_status(el, JSON.parse(e.data));
+    });
+    source.addEventListener('text', function(e){
+        if(!current()){ return; }
+        text = JSON.parse(e.data);
+        if(text != ''){ render(); }
+    });
+    source.addEventListener('chunk', function(e){
+        if(!current()){ return; }
+        text += JSON.parse(e.data);
+        render();
+    });
+    source.addEventListener('done', function(e){
+        source.close();
+        if(!current()){ return; }
+        hostmap_ui_job_finished(el, JSON.parse(e.data));
+    });
+}
+
+
+
+// render the status of a job that has not produced any text yet
+function hostmap_ui_job_status(el, job){
+    var status = job.state == "queued" ? "Queued" : escapeHtml(job.stage || "Generating");
+    if(job.state == "queued" && job.position){
+        status += job.position == 1 ? ", next in line" : ", position "+job.position+" in the queue";
+    }
+    if(job.state == "queued" && job.last_error){
+        status += " (retrying after: "+escapeHtml(job.last_error)+")";
+    }
+    el.innerHTML = "<div class=\"no-report-message-generate\">&nbsp;<br /><br />"+status+" ...<br /><br />"+
+        "<progress value=\""+job.progress+"\" max=\"100\"></progress><br /><br />"+hostmap_ui_job_cancel_button(job.id)+"</div>";
+}
+
+
+
+function hostmap_ui_job_cancel_button(id){
+    return "<button onclick=\"hostmap_ui_job_cancel("+escapeHtml(JSON.stringify(id))+", this)\">Cancel</button>";
+}
+
+
+
+// cancel a queued or running job, the job stream or poll reports the outcome
+async function hostmap_ui_job_cancel(id, button){
+    button.disabled = true;
+    try {
+        const response = await fetch('/report-jobs/'+encodeURIComponent(id)+'/cancel', { method: 'POST' });
+        const json = await response.json();
+        if (!response.ok || json.success != "1") {
+            throw new Error(json.message || `Response status: ${response.status}`);
+        }
+    } catch (error) {
+        alert(error.message);
+        button.disabled = false;
+    }
+}
+
+
+
+// show the outcome of a finished job
+function hostmap_ui_job_finished(el, job){
+    if(job.state == "succeeded"){
+        hostmap_ui_update();
+        return;
+    }
+    if(job.state == "cancelled"){
+        el.innerHTML = "<div class=\"no-report-message-generate\">Report generation cancelled<br /><br /><button onclick=\"hostmap_ui_update()\">Show Report</button> <button onclick=\"hostmap_ui_generate()\">Generate Again</button></div>";
+        return;
+    }
+    el.innerHTML = "<div class=\"no-report-message-generate\">Report generation failed<br /><br /><pre>"+escapeHtml(job.last_error || "")+"</pre><br /><button onclick=\"hostmap_ui_generate()\">Try Again</button></div>";
+}
+
+
+
+// poll the job status until the job has finished, then reload the report
+async function hostmap_ui_job_poll(id, h, d){
+    // stop polling when the user switched to another host or date
+    if(document.getElementById('select-host').value != h || document.getElementById('select-date').value != d){
+        return;
+    }
+    var el = document.getElementById('paila_content_report');
+
+    try {
+        const response = await fetch('/report-jobs/'+encodeURIComponent(id));
+        if (!response.ok) {
+            throw new Error(`Response status: ${response.status}`);
+        }
+        const job = await response.json();
+
+        if(job.state == "succeeded" || job.state == "failed" || job.state == "cancelled"){
+            hostmap_ui_job_finished(el, job);
+            return;
+        }
+        hostmap_ui_job_status(el, job);
+    } catch (error) {
+        // keep polling, the reporter may just be restarting
+        console.error('Error polling job:', error);
+    }
+    setTimeout(function(){ hostmap_ui_job_poll(id, h, d); }, 2000);
+}
+
+
+
 function markdownToHtml(markdown) {
   let html = markdown;
 
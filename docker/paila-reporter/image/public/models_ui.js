@@ -0,0 +1,116 @@
+
+// the models page lists the models of every configured server, the loaded
+// ones and the configured models that are missing. Pulls and warm ups run on
+// the server in the background, the page polls while any of them runs.
+var models_ui_timer = null;
+
+function models_ui_update(){
+    fetch('/model-data')
+        .then(response => {
+            if (!response.ok) {
+                throw new Error(`HTTP error! status: ${response.status}`);
+            }
+            return response.json();
+        })
+        .then(data => {
+            var h = '<div class="models-configured">Configured models: '+data.configured.map(m => '<code>'+escapeHtml(m)+'</code>').join(', ')+'</div>';
+            h += models_ui_tasks(data.tasks);
+            data.backends.forEach((b) => {
+                h += models_ui_backend(b);
+            });
+            document.getElementById('paila_models').innerHTML = h;
+
+            // keep polling while a pull or warm up runs
+            clearTimeout(models_ui_timer);
+            if(data.tasks.some(t => !t.done)){
+                models_ui_timer = setTimeout(models_ui_update, 2000);
+            }
+        })
+        .catch(error => {
+            console.error('Error fetching data:', error);
+            document.getElementById('paila_models').innerHTML = 'Error fetching data';
+        });
+}
+
+
+
+// the pulls and warm ups, running and recently finished
+function models_ui_tasks(tasks){
+    if(tasks.length == 0){
+        return '';
+    }
+    var rows = tasks.map((t) => {
+        var progress = '';
+        if(!t.done && t.total > 0){
+            progress = ' <progress value="'+t.completed+'" max="'+t.total+'"></progress> '+models_ui_size(t.completed)+' of '+models_ui_size(t.total);
+        }
+        return '<tr><td>'+escapeHtml(t.action)+'</td><td><code>'+escapeHtml(t.model)+'</code></td><td>'+escapeHtml(t.backend)+'</td>'+
+            '<td>'+escapeHtml(t.status)+progress+(t.error ? ' <span class="severity severity-critical">'+escapeHtml(t.error)+'</span>' : '')+'</td></tr>';
+    });
+    return '<h3>Tasks</h3><table class="findings"><tr><th>Action</th><th>Model</th><th>Server</th><th>Status</th></tr>'+rows.join('')+'</table>';
+}
+
+
+
+// the models of one server
+function models_ui_backend(b){
+    var h = '<h3>'+escapeHtml(b.kind+' '+b.url)+' '+(b.healthy ? '<span class="severity severity-low">up</span>' : '<span class="severity severity-critical">down</span>')+'</h3>';
+    if(!b.manageable){
+        return h+'<p>Model management is only available for ollama servers.</p>';
+    }
+    if(b.error){
+        return h+'<pre>'+escapeHtml(b.error)+'</pre>';
+    }
+    var u = escapeHtml(JSON.stringify(b.url));
+
+    // the configured models this server does not have yet
+    b.missing.forEach((m) => {
+        h += '<div class="report-notice report-flagged">The configured model <code>'+escapeHtml(m)+'</code> is not pulled on this server. '+
+            '<button onclick="models_ui_action(\'pull\','+u+','+escapeHtml(JSON.stringify(m))+')">Pull</button></div>';
+    });
+
+    var rows = b.models.map((m) => {
+        var loaded = b.loaded.find(l => l.name == m.name);
+        var state = loaded ? 'loaded, '+models_ui_size(loaded.size_vram)+' in VRAM until '+escapeHtml(new Date(loaded.expires_at).toLocaleTimeString()) : '';
+        var name = escapeHtml(JSON.stringify(m.name));
+        return '<tr><td><code>'+escapeHtml(m.name)+'</code></td><td>'+models_ui_size(m.size)+'</td>'+
+            '<td>'+escapeHtml(new Date(m.modified_at).toLocaleString())+'</td><td>'+state+'</td>'+
+            '<td><button onclick="models_ui_action(\'warm\','+u+','+name+')">Warm Up</button> '+
+            '<button onclick="models_ui_action(\'pull\','+u+','+name+')">Update</button></td></tr>';
+    });
+    h += '<table class="findings"><tr><th>Model</th><th>Size</th><th>Modified</th><th>Loaded</th><th></th></tr>'+rows.join('')+'</table>';
+
+    // pull any other model by name
+    var id = 'models-pull-'+b.url.replace(/[^a-zA-Z0-9]/g, '-');
+    h += '<div class="models-pull"><input type="text" id="'+id+'" placeholder="model, e.g. gemma3:12b" /> '+
+        '<button onclick="models_ui_action(\'pull\','+u+',document.getElementById(\''+id+'\').value)">Pull</button></div>';
+    return h;
+}
+
+
+
+// start a pull or warm up on the server
+async function models_ui_action(action, backend, model){
+    if(model == ""){
+        return;
+    }
+    try {
+        const response = await fetch('/model-'+action+'?backend='+encodeURIComponent(backend)+'&model='+encodeURIComponent(model), { method: 'POST' });
+        const json = await response.json();
+        if (!response.ok || json.success != "1") {
+            throw new Error(json.message || `Response status: ${response.status}`);
+        }
+    } catch (error) {
+        alert(error.message);
+    }
+    models_ui_update();
+}
+
+
+
+function models_ui_size(bytes){
+    if(bytes >= 1e9){
+        return (bytes/1e9).toFixed(1)+' GB';
+    }
+    return (bytes/1e6).toFixed(0)+' MB';
+}
@@ -9,11 +9,13 @@
 # Author: Chris Mayenschein
 # GitHub: https://github.com/cmayen/paila
 # Date: 2025-07-20
-# Last Modified: 2025-07-23
+# Last Modified: 2026-10-18
 #
 # Usage: ./paila-logpush.sh
-# Usage: ./paila-logpush.sh [-u output_url] [-d out_directory] [-l log_directory]
-# Example: paila-logpush.sh -u http://localhost:8181/uploadlog -l /var/log
+# Usage: ./paila-logpush.sh [-u output_url] [-t token] [-s secret] [-a ca_cert] [-c client_cert] [-k client_key] [-d out_directory] [-l log_directory]
+# Example: paila-logpush.sh -u http://localhost:8181/uploadlog -t paila_0123... -l /var/log
+# Example: paila-logpush.sh -u https://ingest.lan:8181/uploadlog -a ca.crt -c web01.crt -k web01.key
+# Example: paila-logpush.sh -u http://ingest.lan:8181/uploadlog -s 0123abcd...
 #
 ################################################################################
 
@@ -28,6 +30,29 @@ else
 fi
 
 
+# upload token issued to this host by the paila-ingest server
+# check for PAILA_TOKEN environment variable
+if [[ -z "${PAILA_TOKEN}" ]]; then
+  # not defined, set default
+  TOKEN=""
+else
+  TOKEN="${PAILA_TOKEN}"
+fi
+
+
+# signing secret issued to this host by the paila-ingest server, needs openssl
+# check for PAILA_SECRET environment variable
+SECRET="${PAILA_SECRET}"
+
+
+# TLS files issued by the paila-ingest ca subcommand, the CA certificate
+# to verify the server and the client certificate and key of this host
+# check for PAILA_CACERT, PAILA_CERT and PAILA_KEY environment variables
+CACERT="${PAILA_CACERT}"
+CLIENTCERT="${PAILA_CERT}"
+CLIENTKEY="${PAILA_KEY}"
+
+
 # log file generation location
 # check for PAILA_OUTDIR environment variable
 if [[ -z "${PAILA_OUTDIR}" ]]; then
@@ -51,14 +76,34 @@ fi
 # get passed in options
 # passed options will override env variables
 #   'u:' output url
+#   't:' upload token
+#   's:' signing secret
+#   'a:' CA certificate
+#   'c:' client certificate
+#   'k:' client key
 #   'd:' output directory
 #   'l:' log directory
-while getopts "u:d:l:" opt; do
+while getopts "u:t:s:a:c:k:d:l:" opt; do
   case $opt in
 
     u) # output url curl with call to
       OUTPUTURL=$OPTARG;;
 
+    t) # upload token of this host
+      TOKEN=$OPTARG;;
+
+    s) # signing secret of this host
+      SECRET=$OPTARG;;
+
+    a) # CA certificate to verify the server with
+      CACERT=$OPTARG;;
+
+    c) # client certificate of this host
+      CLIENTCERT=$OPTARG;;
+
+    k) # client key of this host
+      CLIENTKEY=$OPTARG;;
+
     d) # output directory for generated file
       OUTPUTDIR=$OPTARG;;
 
@@ -66,7 +111,7 @@ while getopts "u:d:l:" opt; do
       LOGDIR=$OPTARG;;
 
     \?) # Handle invalid options
-      echo "Usage: $0 [-u output_url] [-d out_directory] [-l log_directory]" >&2
+      echo "Usage: $0 [-u output_url] [-t token] [-s secret] [-a ca_cert] [-c client_cert] [-k client_key] [-d out_directory] [-l log_directory]" >&2
       exit 1;;
   esac
 done
@@ -258,8 +303,33 @@ if [ "$LOGSFOUND" -eq 10 ]; then
 fi
 
 
+# send the token of this host as a bearer header if one is set
+CURLAUTH=()
+if [[ -n "$TOKEN" ]]; then
+  CURLAUTH=(-H "Authorization: Bearer ${TOKEN}")
+fi
+# verify the server with the paila CA and present the client certificate
+if [[ -n "$CACERT" ]]; then
+  CURLAUTH+=(--cacert "${CACERT}")
+fi
+if [[ -n "$CLIENTCERT" ]]; then
+  CURLAUTH+=(--cert "${CLIENTCERT}" --key "${CLIENTKEY}")
+fi
+# sign the upload with the secret of this host, the signature covers the
+# host, date, a timestamp and a random nonce and the hash of the log file
+# so the server can refuse altered, stale and replayed uploads
+if [[ -n "$SECRET" ]]; then
+  SIGTIME=$(date +%s)
+  SIGNONCE=$(openssl rand -hex 16)
+  SIGBODY=$(openssl dgst -sha256 -r "${OUTPUTPATH}" | cut -d' ' -f1)
+  SIGNATURE=$(printf 'paila-v1\n%s\n%s\n%s\n%s\n%s' "${HOST}" "${DATE_S}" "${SIGTIME}" "${SIGNONCE}" "${SIGBODY}" \
+    | openssl dgst -sha256 -mac HMAC -macopt "hexkey:${SECRET}" -r | cut -d' ' -f1)
+  CURLAUTH+=(-H "X-Paila-Timestamp: ${SIGTIME}" -H "X-Paila-Nonce: ${SIGNONCE}" -H "X-Paila-Signature: ${SIGNATURE}")
+fi
+
+
 # use curl to upload the log data file to the server
-CURLRESP=$(curl -F "host=${HOST}" -F "date=${DATE_S}" -F "log=@${OUTPUTPATH}" "${OUTPUTURL}")
+CURLRESP=$(curl "${CURLAUTH[@]}" -F "host=${HOST}" -F "date=${DATE_S}" -F "log=@${OUTPUTPATH}" "${OUTPUTURL}")
 
 
 # check the json response for 201 status text